@@ -19,11 +19,29 @@ import "errors"
 //   G19   - yz arc plane
 //   G20   - imperial mode
 //   G21   - metric mode
+//   G28   - go to predefined position 1 (home)
+//   G28.1 - store predefined position 1
+//   G30   - go to predefined position 2 (home)
+//   G30.1 - store predefined position 2
+//   G54   - work coordinate system 1
+//   G55   - work coordinate system 2
+//   G56   - work coordinate system 3
+//   G57   - work coordinate system 4
+//   G58   - work coordinate system 5
+//   G59   - work coordinate system 6
+//   G54.1 - extended work coordinate system select (P1-P3)
+//   G68   - coordinate system rotation (XY plane)
+//   G69   - cancel coordinate system rotation
 //   G80   - cancel mode (?)
+//   G81   - canned drilling cycle
+//   G82   - canned drilling cycle with dwell
+//   G83   - canned peck drilling cycle
 //   G90   - absolute
 //   G90.1 - absolute arc
 //   G91   - relative
 //   G91.1 - relative arc
+//   G98   - canned cycle return to initial Z level
+//   G99   - canned cycle return to R plane
 //
 //   M02 - end of program
 //   M03 - spindle enable clockwise
@@ -38,7 +56,9 @@ import "errors"
 //   S - spindle speed
 //   P - parameter
 //   X, Y, Z - cartesian movement
+//   A, B, C - rotary axis movement (degrees, no imperial conversion)
 //   I, J, K - arc center definition
+//   R, Q, L - canned cycle retract plane, peck depth and repeat count
 
 //
 // TODO
@@ -47,11 +67,15 @@ import "errors"
 //   Split G/M handling out of the run function
 //   Handle G/M-code priority properly
 //   Better comments
-//   Implement various canned cycles
-//   Variables (basic support?)
-//   Subroutines
 //   Incremental axes
-//   A, B, C axes
+//
+// #-parameters and O-word subroutines/loops are handled ahead of time by
+// the preproc package, which flattens them into the plain G-code this file
+// already understands.
+//
+// Machine state can be serialized and restored with Snapshot/Restore (see
+// snapshot.go), e.g. to pause a long-running program or fork the
+// interpreter for a what-if preview.
 
 type Statement []*gcode.Word
 
@@ -74,7 +98,7 @@ func (stmt Statement) get(address rune) (res float64, err error) {
 
 func (stmt Statement) getDefault(address rune, def float64) (res float64) {
 	res, err := stmt.get(address)
-	if err == nil {
+	if err != nil {
 		return def
 	}
 	return res
@@ -119,6 +143,7 @@ const (
 	moveModeLinear = iota
 	moveModeCWArc  = iota
 	moveModeCCWArc = iota
+	moveModeCanned = iota
 )
 
 // Constants for plane selection
@@ -143,20 +168,38 @@ type State struct {
 type Position struct {
 	state   State
 	x, y, z float64
+	a, b, c float64
+	dwell   float64
+}
+
+// Modal state for the active canned drilling cycle (G81/G82/G83)
+type cannedCycle struct {
+	code          float64
+	r, z, q, p, l float64
+	retractOldZ   bool
+	initialZ      float64
 }
 
 // Machine state and settings
 type Machine struct {
-	state            State
-	metric           bool
-	absoluteMove     bool
-	absoluteArc      bool
-	movePlane        int
-	completed        bool
-	maxArcDeviation  float64
-	minArcLineLength float64
-	tolerance        float64
-	posStack         []Position
+	state             State
+	metric            bool
+	absoluteMove      bool
+	absoluteArc       bool
+	movePlane         int
+	completed         bool
+	maxArcDeviation   float64
+	minArcLineLength  float64
+	tolerance         float64
+	posStack          []Position
+	coordSystems      [9][6]float64
+	activeCoordSystem int
+	homePositions     [2]Position
+	canned            cannedCycle
+	rotActive         bool
+	rotAngle          float64
+	rotPivotX         float64
+	rotPivotY         float64
 }
 
 //
@@ -173,8 +216,9 @@ func (vm *Machine) addPos(pos Position) {
 	vm.posStack = append(vm.posStack, pos)
 }
 
-// Calculates the absolute position of the given statement, including optional I, J, K parameters
-func (vm *Machine) calcPos(stmt Statement) (newX, newY, newZ, newI, newJ, newK float64) {
+// Calculates the absolute position of the given statement, including optional A, B, C
+// rotary axes and I, J, K arc center parameters
+func (vm *Machine) calcPos(stmt Statement) (newX, newY, newZ, newA, newB, newC, newI, newJ, newK float64) {
 	pos := vm.curPos()
 	var err error
 
@@ -196,6 +240,19 @@ func (vm *Machine) calcPos(stmt Statement) (newX, newY, newZ, newI, newJ, newK f
 		newZ *= 25.4
 	}
 
+	// Rotary axes are always in degrees, so no imperial conversion applies
+	if newA, err = stmt.get('A'); err != nil {
+		newA = pos.a
+	}
+
+	if newB, err = stmt.get('B'); err != nil {
+		newB = pos.b
+	}
+
+	if newC, err = stmt.get('C'); err != nil {
+		newC = pos.c
+	}
+
 	newI = stmt.getDefault('I', 0)
 	newJ = stmt.getDefault('J', 0)
 	newK = stmt.getDefault('K', 0)
@@ -204,30 +261,89 @@ func (vm *Machine) calcPos(stmt Statement) (newX, newY, newZ, newI, newJ, newK f
 		newI, newJ, newK = newI*25.4, newJ*25.4, newZ*25.4
 	}
 
-	if !vm.absoluteMove {
+	if vm.absoluteMove {
+		offset := vm.coordSystems[vm.activeCoordSystem]
+		newX, newY, newZ = newX-offset[0], newY-offset[1], newZ-offset[2]
+		newA, newB, newC = newA-offset[3], newB-offset[4], newC-offset[5]
+	} else {
 		newX, newY, newZ = pos.x+newX, pos.y+newY, pos.z+newZ
+		newA, newB, newC = pos.a+newA, pos.b+newB, pos.c+newC
 	}
 
-	if !vm.absoluteArc {
+	if vm.absoluteArc {
+		offset := vm.coordSystems[vm.activeCoordSystem]
+		newI, newJ, newK = newI-offset[0], newJ-offset[1], newK-offset[2]
+	} else {
 		newI, newJ, newK = pos.x+newI, pos.y+newJ, pos.z+newK
 	}
-	return newX, newY, newZ, newI, newJ, newK
+
+	if vm.rotActive {
+		cosT, sinT := math.Cos(vm.rotAngle), math.Sin(vm.rotAngle)
+
+		// In absolute mode newX/newY are an already-resolved work position,
+		// so rotate them as a point about the pivot. In incremental mode
+		// they're pos+delta where pos is itself already rotated - rotating
+		// the whole sum again would rotate it twice, so rotate just the
+		// delta and add it to the already-rotated pos.
+		if vm.absoluteMove {
+			newX, newY = vm.rotPivotX+(newX-vm.rotPivotX)*cosT-(newY-vm.rotPivotY)*sinT, vm.rotPivotY+(newX-vm.rotPivotX)*sinT+(newY-vm.rotPivotY)*cosT
+		} else {
+			dx, dy := newX-pos.x, newY-pos.y
+			newX, newY = pos.x+dx*cosT-dy*sinT, pos.y+dx*sinT+dy*cosT
+		}
+
+		// Same reasoning as above applies to the arc center: in absolute-arc
+		// mode newI/newJ are an already-resolved work position, but in the
+		// default incremental mode they're pos+delta where pos is already
+		// rotated, so only the delta gets rotated.
+		if vm.absoluteArc {
+			newI, newJ = vm.rotPivotX+(newI-vm.rotPivotX)*cosT-(newJ-vm.rotPivotY)*sinT, vm.rotPivotY+(newI-vm.rotPivotX)*sinT+(newJ-vm.rotPivotY)*cosT
+		} else {
+			di, dj := newI-pos.x, newJ-pos.y
+			newI, newJ = pos.x+di*cosT-dj*sinT, pos.y+di*sinT+dj*cosT
+		}
+	}
+
+	return newX, newY, newZ, newA, newB, newC, newI, newJ, newK
+}
+
+// Moves to a predefined position (G28/G30), optionally passing through an
+// intermediate point described by any axis words present in the statement
+func (vm *Machine) goHome(stmt Statement, index int) {
+	if stmt.includes('X', 'Y', 'Z', 'A', 'B', 'C') {
+		newX, newY, newZ, newA, newB, newC, _, _, _ := vm.calcPos(stmt)
+		vm.rapidTo(newX, newY, newZ, newA, newB, newC)
+	}
+
+	home := vm.homePositions[index]
+	vm.rapidTo(home.x, home.y, home.z, home.a, home.b, home.c)
+}
+
+// Stores the offsets (X, Y, Z, A, B, C) of the work coordinate system at the
+// given index (0-5 for G54-G59, 6-8 for G54.1 P1-P3), whether or not it is active
+func (vm *Machine) SetCoordSystem(index int, offsets [6]float64) {
+	vm.coordSystems[index] = offsets
+}
+
+// Stores a predefined position (0 for G28, 1 for G30)
+func (vm *Machine) SetHome(kind int, pos Position) {
+	vm.homePositions[kind] = pos
 }
 
 // Adds a simple linear move
 func (vm *Machine) positioning(stmt Statement) {
-	newX, newY, newZ, _, _, _ := vm.calcPos(stmt)
-	vm.addPos(Position{vm.state, newX, newY, newZ})
+	newX, newY, newZ, newA, newB, newC, _, _, _ := vm.calcPos(stmt)
+	vm.addPos(Position{vm.state, newX, newY, newZ, newA, newB, newC, 0})
 }
 
 // Calculates an approximate arc from the provided statement
 func (vm *Machine) approximateArc(stmt Statement) {
 	var (
-		startPos                           Position = vm.curPos()
-		endX, endY, endZ, endI, endJ, endK float64  = vm.calcPos(stmt)
-		s1, s2, s3, e1, e2, e3, c1, c2     float64
-		add                                func(x, y, z float64)
-		clockwise                          bool = (vm.state.moveMode == moveModeCWArc)
+		startPos                                             Position = vm.curPos()
+		endX, endY, endZ, endA, endB, endC, endI, endJ, endK float64  = vm.calcPos(stmt)
+		s1, s2, s3, e1, e2, e3, c1, c2                       float64
+		add                                                  func(x, y, z, a, b, c float64)
+		clockwise                                            bool = (vm.state.moveMode == moveModeCWArc)
 	)
 
 	vm.state.moveMode = moveModeLinear
@@ -239,25 +355,27 @@ func (vm *Machine) approximateArc(stmt Statement) {
 	}
 
 	//  Flip coordinate system for working in other planes
+	//
+	// add appends an already-resolved absolute position straight to the
+	// stack. It must not go back through calcPos (e.g. via positioning) -
+	// c1/c2/e1/e2 above came from calcPos already, so any work offset or
+	// active rotation is already baked in, and applying it again would
+	// double it up.
 	switch vm.movePlane {
 	case planeXY:
 		s1, s2, s3, e1, e2, e3, c1, c2 = startPos.x, startPos.y, startPos.z, endX, endY, endZ, endI, endJ
-		add = func(x, y, z float64) {
-			wx, wy, wz := gcode.Word{'X', x}, gcode.Word{'Y', y}, gcode.Word{'Z', z}
-			vm.positioning(Statement{&wx, &wy, &wz})
+		add = func(x, y, z, a, b, c float64) {
+			vm.addPos(Position{vm.state, x, y, z, a, b, c, 0})
 		}
 	case planeXZ:
 		s1, s2, s3, e1, e2, e3, c1, c2 = startPos.z, startPos.x, startPos.y, endZ, endX, endY, endK, endI
-		add = func(x, y, z float64) {
-			wx, wy, wz := gcode.Word{'X', y}, gcode.Word{'Y', z}, gcode.Word{'Z', x}
-			vm.positioning(Statement{&wx, &wy, &wz})
-
+		add = func(x, y, z, a, b, c float64) {
+			vm.addPos(Position{vm.state, y, z, x, a, b, c, 0})
 		}
 	case planeYZ:
 		s1, s2, s3, e1, e2, e3, c1, c2 = startPos.y, startPos.z, startPos.x, endY, endZ, endX, endJ, endK
-		add = func(x, y, z float64) {
-			wx, wy, wz := gcode.Word{'X', z}, gcode.Word{'Y', x}, gcode.Word{'Z', y}
-			vm.positioning(Statement{&wx, &wy, &wz})
+		add = func(x, y, z, a, b, c float64) {
+			vm.addPos(Position{vm.state, z, x, y, a, b, c, 0})
 		}
 	}
 
@@ -305,9 +423,14 @@ func (vm *Machine) approximateArc(stmt Statement) {
 		angle = theta1 + angleDiff/float64(steps)*float64(i)
 		a1, a2 := c1+radius1*math.Cos(angle), c2+radius1*math.Sin(angle)
 		a3 := s3 + (e3-s3)/float64(steps)*float64(i)
-		add(a1, a2, a3)
+		// A, B, C are independent rotary axes, not part of the arc plane,
+		// so they simply ride along linearly with the helical third axis
+		ra := startPos.a + (endA-startPos.a)/float64(steps)*float64(i)
+		rb := startPos.b + (endB-startPos.b)/float64(steps)*float64(i)
+		rc := startPos.c + (endC-startPos.c)/float64(steps)*float64(i)
+		add(a1, a2, a3, ra, rb, rc)
 	}
-	add(e1, e2, e3)
+	add(e1, e2, e3, endA, endB, endC)
 }
 
 //
@@ -327,6 +450,7 @@ func (vm *Machine) run(stmt Statement) (err error) {
 	}()
 
 	// G-codes
+	skipPositioning := false
 	for _, g := range stmt.getAll('G') {
 		switch g {
 		case 0:
@@ -347,8 +471,80 @@ func (vm *Machine) run(stmt Statement) (err error) {
 			vm.metric = false
 		case 21:
 			vm.metric = true
+		case 28:
+			vm.goHome(stmt, 0)
+			skipPositioning = true
+		case 28.1:
+			vm.SetHome(0, vm.curPos())
+			skipPositioning = true
+		case 30:
+			vm.goHome(stmt, 1)
+			skipPositioning = true
+		case 30.1:
+			vm.SetHome(1, vm.curPos())
+			skipPositioning = true
+		case 54:
+			vm.activeCoordSystem = 0
+		case 55:
+			vm.activeCoordSystem = 1
+		case 56:
+			vm.activeCoordSystem = 2
+		case 57:
+			vm.activeCoordSystem = 3
+		case 58:
+			vm.activeCoordSystem = 4
+		case 59:
+			vm.activeCoordSystem = 5
+		case 54.1:
+			p := 1.0
+			if pp, err := stmt.get('P'); err == nil {
+				p = pp
+			}
+			if p < 1 || p > 3 {
+				return errors.New("G54.1 requires P1-P3")
+			}
+			vm.activeCoordSystem = 5 + int(p)
+		case 68:
+			pivotX, pivotY := vm.curPos().x, vm.curPos().y
+			if v, err := stmt.get('X'); err == nil {
+				if !vm.metric {
+					v *= 25.4
+				}
+				if vm.absoluteMove {
+					pivotX = v - vm.coordSystems[vm.activeCoordSystem][0]
+				} else {
+					pivotX = vm.curPos().x + v
+				}
+			}
+			if v, err := stmt.get('Y'); err == nil {
+				if !vm.metric {
+					v *= 25.4
+				}
+				if vm.absoluteMove {
+					pivotY = v - vm.coordSystems[vm.activeCoordSystem][1]
+				} else {
+					pivotY = vm.curPos().y + v
+				}
+			}
+			r, err := stmt.get('R')
+			if err != nil {
+				return errors.New("G68 requires an R word")
+			}
+			vm.rotPivotX, vm.rotPivotY = pivotX, pivotY
+			vm.rotAngle = r * math.Pi / 180
+			vm.rotActive = true
+			skipPositioning = true
+		case 69:
+			vm.rotActive = false
 		case 80:
 			vm.state.moveMode = moveModeNone
+		case 81, 82, 83:
+			vm.state.moveMode = moveModeCanned
+			vm.canned.code = g
+		case 98:
+			vm.canned.retractOldZ = true
+		case 99:
+			vm.canned.retractOldZ = false
 		case 90:
 			vm.absoluteMove = true
 		case 90.1:
@@ -405,13 +601,18 @@ func (vm *Machine) run(stmt Statement) (err error) {
 	}
 
 	// X, Y, Z, I, J, K, P
-	hasPositioning := stmt.includes('X', 'Y', 'Z')
+	hasPositioning := stmt.includes('X', 'Y', 'Z', 'A', 'B', 'C') && !skipPositioning
 	if hasPositioning {
-		if vm.state.moveMode == moveModeCWArc || vm.state.moveMode == moveModeCCWArc {
+		switch vm.state.moveMode {
+		case moveModeCWArc, moveModeCCWArc:
 			vm.approximateArc(stmt)
-		} else if vm.state.moveMode == moveModeLinear || vm.state.moveMode == moveModeRapid {
+		case moveModeLinear, moveModeRapid:
 			vm.positioning(stmt)
-		} else {
+		case moveModeCanned:
+			if err := vm.drill(stmt); err != nil {
+				return err
+			}
+		default:
 			return errors.New("Move attempted without an active move mode")
 		}
 	}
@@ -419,6 +620,123 @@ func (vm *Machine) run(stmt Statement) (err error) {
 	return nil
 }
 
+// Adds a rapid move without disturbing the modal move mode
+func (vm *Machine) rapidTo(x, y, z, a, b, c float64) {
+	rapidState := vm.state
+	rapidState.moveMode = moveModeRapid
+	vm.addPos(Position{rapidState, x, y, z, a, b, c, 0})
+}
+
+// Adds a feed move without disturbing the modal move mode
+func (vm *Machine) feedTo(x, y, z, a, b, c float64) {
+	feedState := vm.state
+	feedState.moveMode = moveModeLinear
+	vm.addPos(Position{feedState, x, y, z, a, b, c, 0})
+}
+
+// Runs a single instance of the active canned cycle at the given X, Y,
+// carrying the current rotary axis positions forward unchanged
+func (vm *Machine) runCycle(x, y float64) {
+	c := &vm.canned
+	pos := vm.curPos()
+
+	vm.rapidTo(x, y, vm.curPos().z, pos.a, pos.b, pos.c)
+	vm.rapidTo(x, y, c.r, pos.a, pos.b, pos.c)
+
+	switch c.code {
+	case 81:
+		vm.feedTo(x, y, c.z, pos.a, pos.b, pos.c)
+	case 82:
+		vm.feedTo(x, y, c.z, pos.a, pos.b, pos.c)
+		vm.addPos(Position{vm.state, x, y, c.z, pos.a, pos.b, pos.c, c.p})
+	case 83:
+		z := c.r
+		for z > c.z {
+			z -= c.q
+			if z < c.z {
+				z = c.z
+			}
+			vm.feedTo(x, y, z, pos.a, pos.b, pos.c)
+			if z > c.z {
+				vm.rapidTo(x, y, c.r, pos.a, pos.b, pos.c)
+			}
+		}
+	}
+
+	if c.retractOldZ {
+		vm.rapidTo(x, y, c.initialZ, pos.a, pos.b, pos.c)
+	} else {
+		vm.rapidTo(x, y, c.r, pos.a, pos.b, pos.c)
+	}
+}
+
+// Expands a canned cycle block (G81/G82/G83) into rapid/feed primitives,
+// carrying the modal R/Z/Q/P/L parameters over to subsequent X/Y-only blocks
+func (vm *Machine) drill(stmt Statement) error {
+	c := &vm.canned
+	isNewCycle := stmt.hasWord('G', 81) || stmt.hasWord('G', 82) || stmt.hasWord('G', 83)
+
+	if isNewCycle {
+		c.initialZ = vm.curPos().z
+		c.l = 1
+	}
+
+	if r, err := stmt.get('R'); err == nil {
+		if !vm.metric {
+			r *= 25.4
+		}
+		c.r = r
+	} else if isNewCycle {
+		return errors.New("Canned cycle requires an R word")
+	}
+
+	if q, err := stmt.get('Q'); err == nil {
+		if !vm.metric {
+			q *= 25.4
+		}
+		c.q = q
+	}
+
+	if c.code == 83 && c.q <= 0 {
+		return errors.New("G83 requires a positive Q word")
+	}
+
+	if p, err := stmt.get('P'); err == nil {
+		c.p = p
+	}
+
+	if l, err := stmt.get('L'); err == nil {
+		c.l = l
+	}
+
+	newX, newY, newZ, _, _, _, _, _, _ := vm.calcPos(stmt)
+	if stmt.includes('Z') {
+		c.z = newZ
+	}
+
+	x, y := vm.curPos().x, vm.curPos().y
+	deltaX, deltaY := 0.0, 0.0
+	if vm.absoluteMove {
+		x, y = newX, newY
+	} else {
+		deltaX, deltaY = newX-x, newY-y
+	}
+
+	reps := int(c.l)
+	if reps < 1 {
+		reps = 1
+	}
+
+	for i := 0; i < reps; i++ {
+		if i > 0 {
+			x, y = x+deltaX, y+deltaY
+		}
+		vm.runCycle(x, y)
+	}
+
+	return nil
+}
+
 // Ensure that machine state is correct after execution
 func (vm *Machine) finalize() {
 	if vm.state != vm.curPos().state {
@@ -0,0 +1,335 @@
+package vm
+
+import (
+	"math"
+	"testing"
+
+	"github.com/joushou/gocnc/gcode"
+)
+
+// w is a small helper for building statements in tests.
+func w(address rune, command float64) *gcode.Word {
+	return &gcode.Word{Address: address, Command: command}
+}
+
+func newTestMachine() *Machine {
+	vm := &Machine{}
+	vm.Init(0.002, 0.01, 0.001)
+	return vm
+}
+
+func run(t *testing.T, vm *Machine, words ...*gcode.Word) {
+	t.Helper()
+	if err := vm.run(Statement(words)); err != nil {
+		t.Fatalf("run(%v): %v", words, err)
+	}
+}
+
+func TestWorkCoordinateSystemSwitch(t *testing.T) {
+	vm := newTestMachine()
+	vm.SetCoordSystem(0, [6]float64{10, 0, 0, 0, 0, 0}) // G54
+	vm.SetCoordSystem(1, [6]float64{0, 20, 0, 0, 0, 0}) // G55
+
+	run(t, vm, w('G', 54))
+	run(t, vm, w('G', 1), w('X', 5), w('Y', 5))
+	if pos := vm.curPos(); pos.x != -5 || pos.y != 5 {
+		t.Fatalf("G54: expected (-5, 5), got (%v, %v)", pos.x, pos.y)
+	}
+
+	run(t, vm, w('G', 55))
+	run(t, vm, w('G', 1), w('X', 5), w('Y', 5))
+	if pos := vm.curPos(); pos.x != 5 || pos.y != -15 {
+		t.Fatalf("G55: expected (5, -15), got (%v, %v)", pos.x, pos.y)
+	}
+
+	// Switching back to G54 mid-program should reapply its own offset.
+	run(t, vm, w('G', 54))
+	run(t, vm, w('G', 1), w('X', 0), w('Y', 0))
+	if pos := vm.curPos(); pos.x != -10 || pos.y != 0 {
+		t.Fatalf("G54 (reselected): expected (-10, 0), got (%v, %v)", pos.x, pos.y)
+	}
+}
+
+func TestPredefinedPositions(t *testing.T) {
+	vm := newTestMachine()
+
+	run(t, vm, w('G', 1), w('X', 1), w('Y', 2), w('Z', 3))
+	run(t, vm, w('G', 28.1))
+	run(t, vm, w('G', 1), w('X', 7), w('Y', 8), w('Z', 9))
+	run(t, vm, w('G', 30.1))
+
+	run(t, vm, w('G', 1), w('X', 100), w('Y', 100), w('Z', 100))
+	run(t, vm, w('G', 28))
+	if pos := vm.curPos(); pos.x != 1 || pos.y != 2 || pos.z != 3 {
+		t.Fatalf("G28: expected (1, 2, 3), got (%v, %v, %v)", pos.x, pos.y, pos.z)
+	}
+
+	run(t, vm, w('G', 30))
+	if pos := vm.curPos(); pos.x != 7 || pos.y != 8 || pos.z != 9 {
+		t.Fatalf("G30: expected (7, 8, 9), got (%v, %v, %v)", pos.x, pos.y, pos.z)
+	}
+
+	// G28 with axis words passes through an intermediate point first.
+	run(t, vm, w('G', 28), w('X', 50))
+	positions := vm.posStack
+	intermediate := positions[len(positions)-2]
+	if intermediate.x != 50 {
+		t.Fatalf("expected intermediate rapid through X50, got %v", intermediate.x)
+	}
+	if pos := vm.curPos(); pos.x != 1 || pos.y != 2 || pos.z != 3 {
+		t.Fatalf("G28 final: expected (1, 2, 3), got (%v, %v, %v)", pos.x, pos.y, pos.z)
+	}
+}
+
+func TestAbsoluteArcMode(t *testing.T) {
+	vm := newTestMachine()
+	vm.SetCoordSystem(0, [6]float64{10, 0, 0, 0, 0, 0}) // G54, X offset +10
+
+	run(t, vm, w('G', 54), w('G', 17), w('G', 90), w('G', 90.1))
+	run(t, vm, w('G', 0), w('X', 10), w('Y', 0))
+
+	// With G90.1 active, I/J give the arc center's absolute work position,
+	// so it must get the same G54 offset subtracted as X/Y/Z - otherwise
+	// the center and endpoint disagree and the radius check panics.
+	run(t, vm, w('G', 3), w('X', 0), w('Y', 10), w('I', 0), w('J', 0))
+
+	pos := vm.curPos()
+	if math.Abs(pos.x+10) > 1e-6 || math.Abs(pos.y-10) > 1e-6 {
+		t.Fatalf("expected arc to end at internal (-10, 10), got (%v, %v)", pos.x, pos.y)
+	}
+}
+
+func TestCannedCycleG81Modal(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 0), w('Z', 5))
+	run(t, vm, w('G', 99)) // retract to R plane
+	run(t, vm, w('G', 81), w('X', 0), w('Y', 0), w('R', 2), w('Z', -1))
+
+	if pos := vm.curPos(); pos.x != 0 || pos.y != 0 || pos.z != 2 {
+		t.Fatalf("after G81: expected (0, 0, 2), got (%v, %v, %v)", pos.x, pos.y, pos.z)
+	}
+
+	// Modal continuation: a bare X/Y repeats the cycle with the same R/Z.
+	run(t, vm, w('X', 10), w('Y', 0))
+	if pos := vm.curPos(); pos.x != 10 || pos.y != 0 || pos.z != 2 {
+		t.Fatalf("modal G81 repeat: expected (10, 0, 2), got (%v, %v, %v)", pos.x, pos.y, pos.z)
+	}
+}
+
+func TestCannedCycleG82Dwell(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 99))
+	run(t, vm, w('G', 82), w('X', 0), w('Y', 0), w('R', 2), w('Z', -1), w('P', 1.5))
+
+	if pos := vm.curPos(); pos.z != 2 {
+		t.Fatalf("after G82: expected retract to R=2, got z=%v", pos.z)
+	}
+
+	// Unlike G81, G82 must dwell at the bottom of the hole before
+	// retracting - find that bottom Position and confirm its dwell field
+	// carries the commanded P value.
+	sawDwell := false
+	for _, p := range vm.posStack {
+		if p.z == -1 && p.dwell == 1.5 {
+			sawDwell = true
+		}
+	}
+	if !sawDwell {
+		t.Fatal("expected a Position at the bottom of the G82 hole with dwell = 1.5")
+	}
+}
+
+func TestCannedCycleRetractMode(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 0), w('Z', 9))
+	run(t, vm, w('G', 98)) // G98: retract to initial Z level
+	run(t, vm, w('G', 81), w('X', 0), w('Y', 0), w('R', 2), w('Z', -1))
+
+	if pos := vm.curPos(); pos.z != 9 {
+		t.Fatalf("G98 retract: expected return to initial Z=9, got %v", pos.z)
+	}
+}
+
+func TestCannedCycleG83Peck(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 99))
+	run(t, vm, w('G', 83), w('X', 0), w('Y', 0), w('R', 2), w('Z', -10), w('Q', 3))
+
+	if pos := vm.curPos(); pos.z != 2 {
+		t.Fatalf("after G83: expected retract to R=2, got z=%v", pos.z)
+	}
+
+	// It should have pecked down in Q-sized steps rather than plunging
+	// straight to depth.
+	sawDeepFeed := false
+	for _, p := range vm.posStack {
+		if p.z < -9 {
+			sawDeepFeed = true
+		}
+	}
+	if !sawDeepFeed {
+		t.Fatal("expected the peck cycle to reach near full depth")
+	}
+
+	// The first peck feeds only Q below the R plane: 2 - 3 = -1.
+	sawFirstPeck := false
+	for _, p := range vm.posStack {
+		if p.z == -1 && p.state.moveMode == moveModeLinear {
+			sawFirstPeck = true
+		}
+	}
+	if !sawFirstPeck {
+		t.Fatal("expected a first peck feed to z=-1 (R minus Q)")
+	}
+}
+
+func TestCannedCycleG83RequiresQ(t *testing.T) {
+	vm := newTestMachine()
+	err := vm.run(Statement{w('G', 83), w('X', 0), w('Y', 0), w('R', 1), w('Z', -5)})
+	if err == nil {
+		t.Fatal("expected an error for G83 without a Q word, got nil")
+	}
+}
+
+func TestCoordinateRotationLinearMove(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 68), w('X', 0), w('Y', 0), w('R', 90))
+	run(t, vm, w('G', 1), w('X', 10), w('Y', 0))
+
+	if pos := vm.curPos(); math.Abs(pos.x) > 1e-6 || math.Abs(pos.y-10) > 1e-6 {
+		t.Fatalf("expected rotated move to land at (0, 10), got (%v, %v)", pos.x, pos.y)
+	}
+}
+
+func TestCoordinateRotationArcRadiusCheck(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 68), w('X', 5), w('Y', 5), w('R', 90))
+	run(t, vm, w('G', 0), w('X', 15), w('Y', 5))
+
+	// A rotation is a rigid transform, so an arc whose start/center/end
+	// satisfy the radius-equality check before rotation must still satisfy
+	// it after - this must not panic. The pivot (5, 5) is deliberately not
+	// the arc's center, so this also exercises I/J under an active rotation:
+	// only the I/J delta gets rotated, not the already-rotated start
+	// position it's added to.
+	run(t, vm, w('G', 2), w('X', 5), w('Y', -5), w('I', 0), w('J', -10))
+
+	if pos := vm.curPos(); math.Abs(pos.x-15) > 1e-6 || math.Abs(pos.y-5) > 1e-6 {
+		t.Fatalf("expected the rotated arc to end at (15, 5), got (%v, %v)", pos.x, pos.y)
+	}
+}
+
+func TestCoordinateRotationIncrementalMove(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 68), w('X', 0), w('Y', 0), w('R', 90))
+	run(t, vm, w('G', 1), w('X', 10), w('Y', 0)) // lands at (0, 10), rotated
+
+	// A G91 delta is defined in the unrotated part frame, so rotating it
+	// and adding it to the already-rotated current position must not
+	// rotate the accumulated position a second time.
+	run(t, vm, w('G', 91), w('G', 1), w('X', 10), w('Y', 0))
+
+	if pos := vm.curPos(); math.Abs(pos.x) > 1e-6 || math.Abs(pos.y-20) > 1e-6 {
+		t.Fatalf("expected incremental rotated move to land at (0, 20), got (%v, %v)", pos.x, pos.y)
+	}
+}
+
+func TestCoordinateRotationCancel(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 68), w('X', 0), w('Y', 0), w('R', 90))
+	run(t, vm, w('G', 69))
+	run(t, vm, w('G', 1), w('X', 10), w('Y', 0))
+
+	if pos := vm.curPos(); pos.x != 10 || pos.y != 0 {
+		t.Fatalf("after G69: expected unrotated (10, 0), got (%v, %v)", pos.x, pos.y)
+	}
+}
+
+func TestRotaryAxesLinearAndArc(t *testing.T) {
+	vm := newTestMachine()
+	run(t, vm, w('G', 1), w('X', 1), w('Y', 2), w('Z', 3), w('A', 90), w('B', 45), w('C', 180))
+
+	if pos := vm.curPos(); pos.a != 90 || pos.b != 45 || pos.c != 180 {
+		t.Fatalf("expected rotary axes (90, 45, 180), got (%v, %v, %v)", pos.a, pos.b, pos.c)
+	}
+
+	// A/B/C ride along linearly with a helical arc's 3rd axis.
+	run(t, vm, w('G', 0), w('X', 10), w('Y', 0))
+	run(t, vm, w('G', 2), w('X', 0), w('Y', 10), w('I', -10), w('J', 0), w('A', 180))
+
+	if pos := vm.curPos(); pos.a != 180 {
+		t.Fatalf("expected A axis to reach 180 at the arc's end, got %v", pos.a)
+	}
+}
+
+func TestSnapshotRoundTripMidProgram(t *testing.T) {
+	vmA := newTestMachine()
+	run(t, vmA, w('G', 0), w('X', 10), w('Y', 0))
+	run(t, vmA, w('G', 2), w('X', 0), w('Y', 10), w('I', -10), w('J', 0))
+	run(t, vmA, w('G', 1), w('X', 5), w('Y', 5), w('Z', 1))
+
+	vmB := newTestMachine()
+	run(t, vmB, w('G', 0), w('X', 10), w('Y', 0))
+	run(t, vmB, w('G', 2), w('X', 0), w('Y', 10), w('I', -10), w('J', 0))
+
+	snap, err := vmB.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	vmC := newTestMachine()
+	if err := vmC.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	run(t, vmC, w('G', 1), w('X', 5), w('Y', 5), w('Z', 1))
+
+	want, got := vmA.curPos(), vmC.curPos()
+	if want.x != got.x || want.y != got.y || want.z != got.z {
+		t.Fatalf("restored machine diverged from the reference run: want (%v, %v, %v), got (%v, %v, %v)",
+			want.x, want.y, want.z, got.x, got.y, got.z)
+	}
+}
+
+// Snapshotting mid-program must also preserve WCS offsets, the active
+// rotation, predefined homes and canned-cycle modals - not just the modal
+// state and position stack - or resuming after any of those is in effect
+// produces a silently wrong toolpath.
+func TestSnapshotRoundTripWithWCSRotationAndCanned(t *testing.T) {
+	setup := func(vm *Machine) {
+		vm.SetCoordSystem(0, [6]float64{1, 2, 0, 0, 0, 0}) // G54
+		run(t, vm, w('G', 54))
+		run(t, vm, w('G', 68), w('X', 0), w('Y', 0), w('R', 90))
+		run(t, vm, w('G', 0), w('Z', 5))
+		run(t, vm, w('G', 99))
+		run(t, vm, w('G', 81), w('X', 0), w('Y', 0), w('R', 2), w('Z', -1))
+		run(t, vm, w('G', 28.1))
+	}
+	continue_ := func(vm *Machine) {
+		run(t, vm, w('X', 10), w('Y', 0)) // modal G81 repeat
+		run(t, vm, w('G', 28))            // predefined home, captured above
+	}
+
+	vmA := newTestMachine()
+	setup(vmA)
+	continue_(vmA)
+
+	vmB := newTestMachine()
+	setup(vmB)
+
+	snap, err := vmB.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	vmC := newTestMachine()
+	if err := vmC.Restore(snap); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	continue_(vmC)
+
+	want, got := vmA.curPos(), vmC.curPos()
+	if want.x != got.x || want.y != got.y || want.z != got.z {
+		t.Fatalf("restored machine diverged from the reference run: want (%v, %v, %v), got (%v, %v, %v)",
+			want.x, want.y, want.z, got.x, got.y, got.z)
+	}
+}
@@ -0,0 +1,102 @@
+// Package preproc expands #-parameters and O-word subroutines/flow control
+// into a flat sequence of plain G-code lines. It runs on the raw program
+// text, ahead of gcode.Parse: Process takes source text and returns source
+// text, with every variable reference and control-flow line resolved away,
+// so the result still needs to go through gcode.Parse before vm.Machine can
+// run it. Process does no comment or block-delete handling of its own - it
+// only recognizes #-assignments, #-references, [bracketed] expressions and
+// O-word lines, and passes everything else through untouched for gcode.Parse
+// to interpret as usual.
+package preproc
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Context holds the parameter tables, call stack and label map used while
+// flattening a single program.
+type Context struct {
+	numbered map[int]float64
+	named    map[string]float64
+	labels   map[int]int
+	calls    []frame
+}
+
+// frame is a single subroutine invocation, holding the caller's #1-#30
+// (local) parameters so they can be restored on return, and the line to
+// resume at afterwards.
+type frame struct {
+	saved      map[int]float64
+	returnLine int
+}
+
+// NewContext creates an empty parameter table with no active calls.
+func NewContext() *Context {
+	return &Context{
+		numbered: make(map[int]float64),
+		named:    make(map[string]float64),
+		labels:   make(map[int]int),
+	}
+}
+
+// Get returns the value of a numbered parameter (#1, #2, ...), defaulting to
+// zero for parameters that have never been assigned.
+func (c *Context) Get(n int) float64 {
+	return c.numbered[n]
+}
+
+// Set assigns a numbered parameter.
+func (c *Context) Set(n int, v float64) {
+	c.numbered[n] = v
+}
+
+// GetNamed returns the value of a named parameter (#<foo>).
+func (c *Context) GetNamed(name string) float64 {
+	return c.named[name]
+}
+
+// SetNamed assigns a named parameter.
+func (c *Context) SetNamed(name string, v float64) {
+	c.named[name] = v
+}
+
+// label returns the line index at which subroutine o is defined ("On sub").
+func (c *Context) label(o int) (int, error) {
+	line, ok := c.labels[o]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("O%d: no matching sub", o))
+	}
+	return line, nil
+}
+
+// call pushes a new frame, passing args as local parameters #1..#N and
+// saving the caller's #1-#30 so they can be restored on return.
+func (c *Context) call(args []float64, returnLine int) {
+	saved := make(map[int]float64, 30)
+	for i := 1; i <= 30; i++ {
+		saved[i] = c.numbered[i]
+	}
+	c.calls = append(c.calls, frame{saved, returnLine})
+
+	for i := 1; i <= 30; i++ {
+		delete(c.numbered, i)
+	}
+	for i, v := range args {
+		c.numbered[i+1] = v
+	}
+}
+
+// ret pops the current frame, restoring the caller's local parameters, and
+// reports the line to resume at.
+func (c *Context) ret() (int, error) {
+	if len(c.calls) == 0 {
+		return 0, errors.New("endsub without call")
+	}
+	top := c.calls[len(c.calls)-1]
+	c.calls = c.calls[:len(c.calls)-1]
+	for i, v := range top.saved {
+		c.numbered[i] = v
+	}
+	return top.returnLine, nil
+}
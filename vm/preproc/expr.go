@@ -0,0 +1,428 @@
+package preproc
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenizer splits an RS274-style expression (square-bracket grouping,
+// '#' parameter references, named functions) into a stream of runes we can
+// peek/consume while parsing.
+type tokenizer struct {
+	src []rune
+	pos int
+}
+
+func newTokenizer(s string) *tokenizer {
+	return &tokenizer{src: []rune(s)}
+}
+
+func (t *tokenizer) skipSpace() {
+	for t.pos < len(t.src) && unicode.IsSpace(t.src[t.pos]) {
+		t.pos++
+	}
+}
+
+// skipTo returns the index of the next non-space rune at or after pos,
+// without moving t.pos - used to look ahead past whitespace that should
+// only be consumed once we commit to reading a token.
+func (t *tokenizer) skipTo(pos int) int {
+	for pos < len(t.src) && unicode.IsSpace(t.src[pos]) {
+		pos++
+	}
+	return pos
+}
+
+// peek returns the next non-space rune without consuming anything,
+// including any whitespace before it.
+func (t *tokenizer) peek() rune {
+	i := t.skipTo(t.pos)
+	if i >= len(t.src) {
+		return 0
+	}
+	return t.src[i]
+}
+
+// next consumes and returns the next non-space rune, skipping (and
+// consuming) any leading whitespace.
+func (t *tokenizer) next() rune {
+	t.pos = t.skipTo(t.pos)
+	if t.pos >= len(t.src) {
+		return 0
+	}
+	r := t.src[t.pos]
+	t.pos++
+	return r
+}
+
+// hasPrefix reports whether kw appears next, skipping leading whitespace.
+// It never consumes anything, whether or not kw matches.
+func (t *tokenizer) hasPrefix(kw string) bool {
+	i := t.skipTo(t.pos)
+	return strings.HasPrefix(string(t.src[i:]), kw)
+}
+
+// consumePrefix consumes kw (and any leading whitespace) if it is next.
+func (t *tokenizer) consumePrefix(kw string) bool {
+	i := t.skipTo(t.pos)
+	if !strings.HasPrefix(string(t.src[i:]), kw) {
+		return false
+	}
+	t.pos = i + len(kw)
+	return true
+}
+
+// word reads a run of letters (used for function names and MOD).
+func (t *tokenizer) word() string {
+	t.skipSpace()
+	start := t.pos
+	for t.pos < len(t.src) && unicode.IsLetter(t.src[t.pos]) {
+		t.pos++
+	}
+	return string(t.src[start:t.pos])
+}
+
+var unaryFuncs = map[string]func(float64) float64{
+	"ABS":  math.Abs,
+	"SIN":  func(x float64) float64 { return math.Sin(x * math.Pi / 180) },
+	"COS":  func(x float64) float64 { return math.Cos(x * math.Pi / 180) },
+	"ATAN": func(x float64) float64 { return math.Atan(x) * 180 / math.Pi },
+	"SQRT": math.Sqrt,
+	"FIX":  math.Floor,
+	"FUP":  math.Ceil,
+}
+
+// Eval evaluates an RS274 expression such as "[#1 + 2] * SIN[#<angle>]" to a
+// float64, resolving #-parameters against the context.
+func (c *Context) Eval(expr string) (float64, error) {
+	t := newTokenizer(expr)
+	v, err := c.parseLogical(t)
+	if err != nil {
+		return 0, err
+	}
+	if t.peek() != 0 {
+		return 0, errors.New(fmt.Sprintf("unexpected trailing input: %q", string(t.src[t.pos:])))
+	}
+	return v, nil
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseLogical handles the lowest precedence operators: the logical AND,
+// OR and XOR used to combine conditions in "if"/"while" statements.
+func (c *Context) parseLogical(t *tokenizer) (float64, error) {
+	v, err := c.parseCompare(t)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case isWordAhead(t, "AND"):
+			t.word()
+			rhs, err := c.parseCompare(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v != 0 && rhs != 0)
+		case isWordAhead(t, "OR"):
+			t.word()
+			rhs, err := c.parseCompare(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v != 0 || rhs != 0)
+		case isWordAhead(t, "XOR"):
+			t.word()
+			rhs, err := c.parseCompare(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat((v != 0) != (rhs != 0))
+		default:
+			return v, nil
+		}
+	}
+}
+
+// parseCompare handles the EQ, NE, GT, GE, LT and LE comparison operators,
+// which bind tighter than AND/OR/XOR but looser than + and -.
+func (c *Context) parseCompare(t *tokenizer) (float64, error) {
+	v, err := c.parseExpr(t)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case isWordAhead(t, "EQ"):
+			t.word()
+			rhs, err := c.parseExpr(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v == rhs)
+		case isWordAhead(t, "NE"):
+			t.word()
+			rhs, err := c.parseExpr(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v != rhs)
+		case isWordAhead(t, "GE"):
+			t.word()
+			rhs, err := c.parseExpr(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v >= rhs)
+		case isWordAhead(t, "GT"):
+			t.word()
+			rhs, err := c.parseExpr(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v > rhs)
+		case isWordAhead(t, "LE"):
+			t.word()
+			rhs, err := c.parseExpr(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v <= rhs)
+		case isWordAhead(t, "LT"):
+			t.word()
+			rhs, err := c.parseExpr(t)
+			if err != nil {
+				return 0, err
+			}
+			v = boolToFloat(v < rhs)
+		default:
+			return v, nil
+		}
+	}
+}
+
+// parseExpr handles the next precedence level: + and -.
+func (c *Context) parseExpr(t *tokenizer) (float64, error) {
+	v, err := c.parseTerm(t)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch t.peek() {
+		case '+':
+			t.next()
+			rhs, err := c.parseTerm(t)
+			if err != nil {
+				return 0, err
+			}
+			v += rhs
+		case '-':
+			t.next()
+			rhs, err := c.parseTerm(t)
+			if err != nil {
+				return 0, err
+			}
+			v -= rhs
+		default:
+			return v, nil
+		}
+	}
+}
+
+// parseTerm handles *, / and MOD.
+func (c *Context) parseTerm(t *tokenizer) (float64, error) {
+	v, err := c.parsePower(t)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch {
+		case t.hasPrefix("**"):
+			// Binds tighter than '*', handled in parsePower.
+			return v, nil
+		case t.peek() == '*':
+			t.next()
+			rhs, err := c.parsePower(t)
+			if err != nil {
+				return 0, err
+			}
+			v *= rhs
+		case t.peek() == '/':
+			t.next()
+			rhs, err := c.parsePower(t)
+			if err != nil {
+				return 0, err
+			}
+			if rhs == 0 {
+				return 0, errors.New("division by zero")
+			}
+			v /= rhs
+		case isWordAhead(t, "MOD"):
+			t.word()
+			rhs, err := c.parsePower(t)
+			if err != nil {
+				return 0, err
+			}
+			v = math.Mod(v, rhs)
+		default:
+			return v, nil
+		}
+	}
+}
+
+// parsePower handles the right-associative ** operator.
+func (c *Context) parsePower(t *tokenizer) (float64, error) {
+	v, err := c.parseUnary(t)
+	if err != nil {
+		return 0, err
+	}
+	if t.consumePrefix("**") {
+		rhs, err := c.parsePower(t)
+		if err != nil {
+			return 0, err
+		}
+		return math.Pow(v, rhs), nil
+	}
+	return v, nil
+}
+
+func (c *Context) parseUnary(t *tokenizer) (float64, error) {
+	if t.peek() == '-' {
+		t.next()
+		v, err := c.parseUnary(t)
+		return -v, err
+	}
+	if t.peek() == '+' {
+		t.next()
+		return c.parseUnary(t)
+	}
+	return c.parseAtom(t)
+}
+
+func (c *Context) parseAtom(t *tokenizer) (float64, error) {
+	switch r := t.peek(); {
+	case r == '[':
+		t.next()
+		v, err := c.parseLogical(t)
+		if err != nil {
+			return 0, err
+		}
+		if t.next() != ']' {
+			return 0, errors.New("expected ']'")
+		}
+		return v, nil
+	case r == '#':
+		return c.parseParamRef(t)
+	case unicode.IsLetter(r):
+		name := t.word()
+		if fn, ok := unaryFuncs[name]; ok {
+			if name == "ATAN" && t.peek() == '[' {
+				// ATAN[y]/[x] two-argument arctangent
+				t.next()
+				y, err := c.parseLogical(t)
+				if err != nil {
+					return 0, err
+				}
+				if t.next() != ']' {
+					return 0, errors.New("expected ']'")
+				}
+				if t.peek() == '/' {
+					t.next()
+					if t.next() != '[' {
+						return 0, errors.New("expected '[' after ATAN[y]/")
+					}
+					x, err := c.parseLogical(t)
+					if err != nil {
+						return 0, err
+					}
+					if t.next() != ']' {
+						return 0, errors.New("expected ']'")
+					}
+					return math.Atan2(y, x) * 180 / math.Pi, nil
+				}
+				return fn(y), nil
+			}
+			if t.next() != '[' {
+				return 0, errors.New(fmt.Sprintf("expected '[' after %s", name))
+			}
+			arg, err := c.parseLogical(t)
+			if err != nil {
+				return 0, err
+			}
+			if t.next() != ']' {
+				return 0, errors.New("expected ']'")
+			}
+			return fn(arg), nil
+		}
+		return 0, errors.New(fmt.Sprintf("unknown function %q", name))
+	default:
+		return c.parseNumber(t)
+	}
+}
+
+func (c *Context) parseParamRef(t *tokenizer) (float64, error) {
+	t.next() // consume '#'
+	if t.peek() == '<' {
+		t.next()
+		start := t.pos
+		for t.pos < len(t.src) && t.src[t.pos] != '>' {
+			t.pos++
+		}
+		name := string(t.src[start:t.pos])
+		if t.next() != '>' {
+			return 0, errors.New("expected '>'")
+		}
+		return c.GetNamed(name), nil
+	}
+	n, err := c.parseInt(t)
+	if err != nil {
+		return 0, err
+	}
+	return c.Get(n), nil
+}
+
+func (c *Context) parseInt(t *tokenizer) (int, error) {
+	start := t.pos
+	t.skipSpace()
+	start = t.pos
+	for t.pos < len(t.src) && unicode.IsDigit(t.src[t.pos]) {
+		t.pos++
+	}
+	if t.pos == start {
+		return 0, errors.New("expected a number")
+	}
+	return strconv.Atoi(string(t.src[start:t.pos]))
+}
+
+func (c *Context) parseNumber(t *tokenizer) (float64, error) {
+	t.skipSpace()
+	start := t.pos
+	for t.pos < len(t.src) && (unicode.IsDigit(t.src[t.pos]) || t.src[t.pos] == '.') {
+		t.pos++
+	}
+	if t.pos == start {
+		return 0, errors.New(fmt.Sprintf("unexpected character %q", string(t.src[t.pos:])))
+	}
+	return strconv.ParseFloat(string(t.src[start:t.pos]), 64)
+}
+
+// isWordAhead reports whether the next token is exactly the given keyword,
+// without consuming it.
+func isWordAhead(t *tokenizer, kw string) bool {
+	save := t.pos
+	t.skipSpace()
+	start := t.pos
+	w := t.word()
+	t.pos = save
+	_ = start
+	return w == kw
+}
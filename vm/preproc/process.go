@@ -0,0 +1,362 @@
+package preproc
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	oWordRe  = regexp.MustCompile(`^[Oo](\d+)\s+([A-Za-z]+)\s*(.*)$`)
+	assignRe = regexp.MustCompile(`^#(<[^>]+>|\d+)\s*=\s*(.+)$`)
+)
+
+var openKeyword = map[string]bool{"sub": true, "if": true, "while": true, "repeat": true}
+var closeKeyword = map[string]bool{"endsub": true, "endif": true, "endwhile": true, "endrepeat": true}
+
+// parseOWord splits a "O<n> <keyword> <rest>" line. ok is false for any
+// line that isn't an O-word line.
+func parseOWord(line string) (o int, keyword, rest string, ok bool) {
+	m := oWordRe.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return 0, "", "", false
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, "", "", false
+	}
+	return n, strings.ToLower(m[2]), m[3], true
+}
+
+// scanControl scans forward from start+1 for the line that closes the
+// control block opened at start, returning its index. Any keyword present
+// in stops also terminates the scan while still at nesting depth zero -
+// used to find the next branch (elseif/else) of a false "if".
+func scanControl(lines []string, start int, stops map[string]bool) (int, string, error) {
+	depth := 0
+	for i := start + 1; i < len(lines); i++ {
+		_, kw, _, ok := parseOWord(lines[i])
+		if !ok {
+			continue
+		}
+		switch {
+		case openKeyword[kw]:
+			depth++
+		case closeKeyword[kw]:
+			if depth == 0 {
+				return i, kw, nil
+			}
+			depth--
+		default:
+			if depth == 0 && stops[kw] {
+				return i, kw, nil
+			}
+		}
+	}
+	return -1, "", errors.New("unterminated O-word block")
+}
+
+// scanBackToOpen scans backward from an "end*" line to find the line that
+// opened the same block (used to re-check a while's condition).
+func scanBackToOpen(lines []string, end int, open string) (int, error) {
+	depth := 0
+	for i := end - 1; i >= 0; i-- {
+		_, kw, _, ok := parseOWord(lines[i])
+		if !ok {
+			continue
+		}
+		switch {
+		case closeKeyword[kw]:
+			depth++
+		case openKeyword[kw]:
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if kw == open {
+				return i, nil
+			}
+			return -1, errors.New("mismatched O-word block")
+		}
+	}
+	return -1, errors.New("unterminated O-word block")
+}
+
+// parseArgs splits "[expr1] [expr2] ..." into its top-level bracket groups
+// and evaluates each with ctx.Eval. It tracks bracket depth itself rather
+// than matching with a regex, so a group containing its own nested
+// brackets (a function call like ABS[-3], or a parenthesized
+// sub-expression like [1 + [2 * 3]]) is found whole instead of only its
+// innermost pair.
+func parseArgs(ctx *Context, rest string) ([]float64, error) {
+	r := []rune(rest)
+	var args []float64
+
+	for i := 0; i < len(r); {
+		for i < len(r) && unicode.IsSpace(r[i]) {
+			i++
+		}
+		if i >= len(r) {
+			break
+		}
+		if r[i] != '[' {
+			return nil, errors.New(fmt.Sprintf("expected '[', got %q", string(r[i:])))
+		}
+
+		start := i
+		depth := 0
+		for ; i < len(r); i++ {
+			switch r[i] {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+			if depth == 0 {
+				i++
+				break
+			}
+		}
+		if depth != 0 {
+			return nil, errors.New("unterminated bracket group")
+		}
+
+		v, err := ctx.Eval(string(r[start+1 : i-1]))
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, v)
+	}
+
+	return args, nil
+}
+
+// expandLine substitutes every #-parameter reference and [bracketed]
+// expression in a plain G-code line with its evaluated literal value,
+// leaving addresses and everything else untouched.
+func (c *Context) expandLine(line string) (string, error) {
+	r := []rune(line)
+	var out strings.Builder
+	for i := 0; i < len(r); {
+		switch r[i] {
+		case '#':
+			t := &tokenizer{src: r, pos: i}
+			v, err := c.parseParamRef(t)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&out, "%g", v)
+			i = t.pos
+		case '[':
+			t := &tokenizer{src: r, pos: i}
+			v, err := c.parseExpr(t)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&out, "%g", v)
+			i = t.pos
+		default:
+			out.WriteRune(r[i])
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+func (c *Context) assign(target, rhs string) error {
+	v, err := c.Eval(rhs)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(target, "<") {
+		c.SetNamed(strings.Trim(target, "<>"), v)
+		return nil
+	}
+	n, err := strconv.Atoi(target)
+	if err != nil {
+		return err
+	}
+	c.Set(n, v)
+	return nil
+}
+
+// Process expands #-parameters and O-word subroutines/loops/conditionals in
+// a raw G-code program, returning flattened plain G-code text with every
+// variable and control-flow line resolved to literal words. The result is
+// still source text, not a gcode.Document - pass it through gcode.Parse
+// before handing it to vm.Machine.Process.
+func Process(src string) (string, error) {
+	lines := strings.Split(src, "\n")
+	ctx := NewContext()
+
+	// First scan: record where every subroutine is defined so "call" can
+	// jump to it regardless of where it's invoked from.
+	for i, line := range lines {
+		if o, kw, _, ok := parseOWord(line); ok && kw == "sub" {
+			ctx.labels[o] = i
+		}
+	}
+
+	repeatsLeft := make(map[int]int)
+	branchTaken := make(map[int]bool)
+	var out []string
+
+	pc := 0
+	for pc < len(lines) {
+		line := lines[pc]
+		trimmed := strings.TrimSpace(line)
+
+		if o, kw, rest, ok := parseOWord(trimmed); ok {
+			switch kw {
+			case "sub":
+				end, _, err := scanControl(lines, pc, nil)
+				if err != nil {
+					return "", err
+				}
+				pc = end + 1
+			case "endsub":
+				ret, err := ctx.ret()
+				if err != nil {
+					return "", err
+				}
+				pc = ret + 1
+			case "call":
+				args, err := parseArgs(ctx, rest)
+				if err != nil {
+					return "", err
+				}
+				label, err := ctx.label(o)
+				if err != nil {
+					return "", err
+				}
+				ctx.call(args, pc)
+				pc = label + 1
+			case "if":
+				endif, _, err := scanControl(lines, pc, nil)
+				if err != nil {
+					return "", err
+				}
+				// Reset in case this if/elseif/else/endif chain is being
+				// re-entered by an enclosing while/repeat loop.
+				branchTaken[endif] = false
+				v, err := ctx.Eval(rest)
+				if err != nil {
+					return "", err
+				}
+				if v != 0 {
+					branchTaken[endif] = true
+					pc++
+				} else {
+					next, _, err := scanControl(lines, pc, map[string]bool{"elseif": true, "else": true})
+					if err != nil {
+						return "", err
+					}
+					pc = next
+				}
+			case "elseif", "else":
+				endif, _, err := scanControl(lines, pc, nil)
+				if err != nil {
+					return "", err
+				}
+				if branchTaken[endif] {
+					// Fell out of an already-taken branch: skip to endif.
+					pc = endif + 1
+				} else if kw == "else" {
+					// No earlier branch matched: its body always runs.
+					branchTaken[endif] = true
+					pc++
+				} else {
+					// Reached via a false preceding branch: evaluate this
+					// elseif's own condition like a fresh "if".
+					v, err := ctx.Eval(rest)
+					if err != nil {
+						return "", err
+					}
+					if v != 0 {
+						branchTaken[endif] = true
+						pc++
+					} else {
+						next, _, err := scanControl(lines, pc, map[string]bool{"elseif": true, "else": true})
+						if err != nil {
+							return "", err
+						}
+						pc = next
+					}
+				}
+			case "endif":
+				pc++
+			case "while":
+				v, err := ctx.Eval(rest)
+				if err != nil {
+					return "", err
+				}
+				if v != 0 {
+					pc++
+				} else {
+					end, _, err := scanControl(lines, pc, nil)
+					if err != nil {
+						return "", err
+					}
+					pc = end + 1
+				}
+			case "endwhile":
+				start, err := scanBackToOpen(lines, pc, "while")
+				if err != nil {
+					return "", err
+				}
+				pc = start
+			case "repeat":
+				if _, started := repeatsLeft[pc]; !started {
+					n, err := parseArgs(ctx, rest)
+					if err != nil {
+						return "", err
+					}
+					if len(n) != 1 {
+						return "", errors.New("repeat requires a single count")
+					}
+					repeatsLeft[pc] = int(n[0])
+				}
+				if repeatsLeft[pc] > 0 {
+					pc++
+				} else {
+					delete(repeatsLeft, pc)
+					end, _, err := scanControl(lines, pc, nil)
+					if err != nil {
+						return "", err
+					}
+					pc = end + 1
+				}
+			case "endrepeat":
+				start, err := scanBackToOpen(lines, pc, "repeat")
+				if err != nil {
+					return "", err
+				}
+				repeatsLeft[start]--
+				pc = start
+			default:
+				return "", errors.New(fmt.Sprintf("unknown O-word keyword %q", kw))
+			}
+			continue
+		}
+
+		if m := assignRe.FindStringSubmatch(trimmed); m != nil {
+			if err := ctx.assign(m[1], m[2]); err != nil {
+				return "", err
+			}
+			pc++
+			continue
+		}
+
+		expanded, err := ctx.expandLine(line)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, expanded)
+		pc++
+	}
+
+	return strings.Join(out, "\n"), nil
+}
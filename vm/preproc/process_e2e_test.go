@@ -0,0 +1,35 @@
+package preproc
+
+import (
+	"testing"
+
+	"github.com/joushou/gocnc/gcode"
+	"github.com/joushou/gocnc/vm"
+)
+
+// TestProcessFeedsGcodeParseAndMachineProcess confirms Process's output is
+// actual gcode.Parse-able source text, not a pre-parsed block stream: the
+// flattened text must survive a real gcode.Parse -> vm.Machine.Process run.
+func TestProcessFeedsGcodeParseAndMachineProcess(t *testing.T) {
+	src := `#1 = 3
+O100 while [#1 GT 0]
+G1 X[#1]
+#1 = [#1 - 1]
+O100 endwhile`
+
+	expanded, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+
+	doc, err := gcode.Parse(expanded)
+	if err != nil {
+		t.Fatalf("gcode.Parse(Process(...)): %v", err)
+	}
+
+	m := &vm.Machine{}
+	m.Init(0.002, 0.01, 0.001)
+	if err := m.Process(doc); err != nil {
+		t.Fatalf("Machine.Process: %v", err)
+	}
+}
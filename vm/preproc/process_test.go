@@ -0,0 +1,159 @@
+package preproc
+
+import (
+	"strings"
+	"testing"
+)
+
+// nonBlankLines splits Process's output and drops any empty lines, since
+// tests only care about the emitted G-code statements.
+func nonBlankLines(s string) []string {
+	var out []string
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) != "" {
+			out = append(out, strings.TrimSpace(l))
+		}
+	}
+	return out
+}
+
+func TestRecursiveSubroutine(t *testing.T) {
+	src := `O100 sub
+X[#1]
+O110 if [#1 GT 1]
+O100 call [#1 - 1]
+O110 endif
+O100 endsub
+O100 call [3]`
+
+	got, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	want := []string{"X3", "X2", "X1"}
+	lines := nonBlankLines(got)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", lines, want)
+	}
+}
+
+func TestSubroutineWithWhileLoopAndArguments(t *testing.T) {
+	src := `O200 sub
+O210 while [#1 GT 0]
+X[#1]
+#1 = [#1 - 1]
+O210 endwhile
+O200 endsub
+O200 call [3]`
+
+	got, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	want := []string{"X3", "X2", "X1"}
+	lines := nonBlankLines(got)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", lines, want)
+	}
+}
+
+func TestNestedWhileInsideRepeat(t *testing.T) {
+	src := `O300 repeat [2]
+O310 while [#1 LT 2]
+X[#1]
+#1 = [#1 + 1]
+O310 endwhile
+#1 = 0
+O300 endrepeat`
+
+	got, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	want := []string{"X0", "X1", "X0", "X1"}
+	lines := nonBlankLines(got)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", lines, want)
+	}
+}
+
+func TestIfElseifElseChain(t *testing.T) {
+	src := `O1 if [0]
+X1
+O1 elseif [1]
+X2
+O1 else
+X3
+O1 endif`
+
+	got, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	want := []string{"X2"}
+	lines := nonBlankLines(got)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", lines, want)
+	}
+}
+
+func TestIfWithCompoundCondition(t *testing.T) {
+	src := `#1 = 2
+O1 if [#1 GT 1] AND [#1 LT 5]
+X1
+O1 else
+X2
+O1 endif`
+
+	got, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	want := []string{"X1"}
+	lines := nonBlankLines(got)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", lines, want)
+	}
+}
+
+func TestCallAndRepeatArgsWithNestedBrackets(t *testing.T) {
+	src := `O100 sub
+X[#1]
+O100 endsub
+O100 call [ABS[-3]]
+O100 call [1 + [2 * 3]]
+#1 = 2
+O300 repeat [1 + [#1]]
+X9
+O300 endrepeat`
+
+	got, err := Process(src)
+	if err != nil {
+		t.Fatalf("Process: %v", err)
+	}
+	want := []string{"X3", "X7", "X9", "X9", "X9"}
+	lines := nonBlankLines(got)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("got %v, want %v", lines, want)
+	}
+}
+
+func TestComparisonAndLogicalOperators(t *testing.T) {
+	ctx := NewContext()
+	ctx.Set(1, 2)
+	v, err := ctx.Eval("[#1 LT 3] AND [#1 GT 0]")
+	if err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	if v != 1 {
+		t.Fatalf("expected true (1), got %v", v)
+	}
+
+	v, err = ctx.Eval("[#1 EQ 5] OR [#1 NE 5]")
+	if err != nil {
+		t.Fatalf("Eval: %v", err)
+	}
+	if v != 1 {
+		t.Fatalf("expected true (1), got %v", v)
+	}
+}
@@ -0,0 +1,187 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+)
+
+// Binary snapshot format: a fixed magic, a single version byte, and a gob
+// stream of snapshotMachine. The magic+version prefix lets Restore reject
+// foreign data and lets a future format change bump the version without
+// breaking snapshots already on disk.
+const (
+	snapshotMagic   = "GCVM"
+	snapshotVersion = 2
+)
+
+// gob only encodes exported fields, so the unexported State/Position/Machine
+// fields are mirrored here for the wire format.
+type snapshotState struct {
+	Feedrate         float64
+	SpindleSpeed     float64
+	MoveMode         int
+	SpindleEnabled   bool
+	SpindleClockwise bool
+	FloodCoolant     bool
+	MistCoolant      bool
+}
+
+type snapshotPosition struct {
+	State                   snapshotState
+	X, Y, Z, A, B, C, Dwell float64
+}
+
+type snapshotCannedCycle struct {
+	Code          float64
+	R, Z, Q, P, L float64
+	RetractOldZ   bool
+	InitialZ      float64
+}
+
+type snapshotMachine struct {
+	State             snapshotState
+	Metric            bool
+	AbsoluteMove      bool
+	AbsoluteArc       bool
+	MovePlane         int
+	Completed         bool
+	MaxArcDeviation   float64
+	MinArcLineLength  float64
+	Tolerance         float64
+	PosStack          []snapshotPosition
+	CoordSystems      [9][6]float64
+	ActiveCoordSystem int
+	HomePositions     [2]snapshotPosition
+	Canned            snapshotCannedCycle
+	RotActive         bool
+	RotAngle          float64
+	RotPivotX         float64
+	RotPivotY         float64
+}
+
+func toSnapshotState(s State) snapshotState {
+	return snapshotState{
+		Feedrate:         s.feedrate,
+		SpindleSpeed:     s.spindleSpeed,
+		MoveMode:         s.moveMode,
+		SpindleEnabled:   s.spindleEnabled,
+		SpindleClockwise: s.spindleClockwise,
+		FloodCoolant:     s.floodCoolant,
+		MistCoolant:      s.mistCoolant,
+	}
+}
+
+func fromSnapshotState(s snapshotState) State {
+	return State{
+		feedrate:         s.Feedrate,
+		spindleSpeed:     s.SpindleSpeed,
+		moveMode:         s.MoveMode,
+		spindleEnabled:   s.SpindleEnabled,
+		spindleClockwise: s.SpindleClockwise,
+		floodCoolant:     s.FloodCoolant,
+		mistCoolant:      s.MistCoolant,
+	}
+}
+
+func toSnapshotPosition(p Position) snapshotPosition {
+	return snapshotPosition{toSnapshotState(p.state), p.x, p.y, p.z, p.a, p.b, p.c, p.dwell}
+}
+
+func fromSnapshotPosition(p snapshotPosition) Position {
+	return Position{fromSnapshotState(p.State), p.X, p.Y, p.Z, p.A, p.B, p.C, p.Dwell}
+}
+
+func toSnapshotCannedCycle(c cannedCycle) snapshotCannedCycle {
+	return snapshotCannedCycle{c.code, c.r, c.z, c.q, c.p, c.l, c.retractOldZ, c.initialZ}
+}
+
+func fromSnapshotCannedCycle(c snapshotCannedCycle) cannedCycle {
+	return cannedCycle{c.Code, c.R, c.Z, c.Q, c.P, c.L, c.RetractOldZ, c.InitialZ}
+}
+
+// Snapshot encodes the machine's full modal state - including work
+// coordinate systems, predefined positions, the active canned cycle and G68
+// rotation - into a versioned binary blob, so the machine can be resumed (or
+// forked) with all of it intact.
+func (vm *Machine) Snapshot() ([]byte, error) {
+	snap := snapshotMachine{
+		State:             toSnapshotState(vm.state),
+		Metric:            vm.metric,
+		AbsoluteMove:      vm.absoluteMove,
+		AbsoluteArc:       vm.absoluteArc,
+		MovePlane:         vm.movePlane,
+		Completed:         vm.completed,
+		MaxArcDeviation:   vm.maxArcDeviation,
+		MinArcLineLength:  vm.minArcLineLength,
+		Tolerance:         vm.tolerance,
+		PosStack:          make([]snapshotPosition, len(vm.posStack)),
+		CoordSystems:      vm.coordSystems,
+		ActiveCoordSystem: vm.activeCoordSystem,
+		Canned:            toSnapshotCannedCycle(vm.canned),
+		RotActive:         vm.rotActive,
+		RotAngle:          vm.rotAngle,
+		RotPivotX:         vm.rotPivotX,
+		RotPivotY:         vm.rotPivotY,
+	}
+
+	for i, p := range vm.posStack {
+		snap.PosStack[i] = toSnapshotPosition(p)
+	}
+	for i, p := range vm.homePositions {
+		snap.HomePositions[i] = toSnapshotPosition(p)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	buf.WriteByte(snapshotVersion)
+	if err := gob.NewEncoder(&buf).Encode(snap); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the machine's entire state with one previously produced
+// by Snapshot, so that a paused program can resume (or be forked for a
+// what-if preview) without re-running the whole document.
+func (vm *Machine) Restore(data []byte) error {
+	if len(data) < len(snapshotMagic)+1 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return errors.New("vm: invalid snapshot magic")
+	}
+	if data[len(snapshotMagic)] != snapshotVersion {
+		return errors.New("vm: unsupported snapshot version")
+	}
+
+	var snap snapshotMachine
+	if err := gob.NewDecoder(bytes.NewReader(data[len(snapshotMagic)+1:])).Decode(&snap); err != nil {
+		return err
+	}
+
+	vm.state = fromSnapshotState(snap.State)
+	vm.metric = snap.Metric
+	vm.absoluteMove = snap.AbsoluteMove
+	vm.absoluteArc = snap.AbsoluteArc
+	vm.movePlane = snap.MovePlane
+	vm.completed = snap.Completed
+	vm.maxArcDeviation = snap.MaxArcDeviation
+	vm.minArcLineLength = snap.MinArcLineLength
+	vm.tolerance = snap.Tolerance
+	vm.coordSystems = snap.CoordSystems
+	vm.activeCoordSystem = snap.ActiveCoordSystem
+	vm.canned = fromSnapshotCannedCycle(snap.Canned)
+	vm.rotActive = snap.RotActive
+	vm.rotAngle = snap.RotAngle
+	vm.rotPivotX = snap.RotPivotX
+	vm.rotPivotY = snap.RotPivotY
+
+	vm.posStack = make([]Position, len(snap.PosStack))
+	for i, p := range snap.PosStack {
+		vm.posStack[i] = fromSnapshotPosition(p)
+	}
+	for i, p := range snap.HomePositions {
+		vm.homePositions[i] = fromSnapshotPosition(p)
+	}
+
+	return nil
+}